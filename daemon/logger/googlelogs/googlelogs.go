@@ -2,14 +2,23 @@
 package googlelogs
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/daemon/logger"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/compute/metadata"
 	"google.golang.org/cloud/logging"
@@ -18,6 +27,37 @@ import (
 const (
 	name         = "googlelogs"
 	logStreamKey = "googlelogs-stream"
+
+	batchSizeKey     = "googlelogs-batch-size"
+	batchIntervalKey = "googlelogs-batch-interval"
+	bufferSizeKey    = "googlelogs-buffer-size"
+	logNameKey       = "googlelogs-log-name"
+
+	projectKey      = "googlelogs-project"
+	zoneKey         = "googlelogs-zone"
+	instanceNameKey = "googlelogs-instance-name"
+	credentialsKey  = "googlelogs-credentials"
+	resourceTypeKey = "googlelogs-resource-type"
+	labelsKey       = "googlelogs-labels"
+	parseJSONKey    = "googlelogs-parse-json"
+
+	defaultBatchSize     = 1000
+	defaultBatchInterval = 5 * time.Second
+	defaultBufferSize    = 10000
+	maxBatchBytes        = 1 << 20 // 1MB
+
+	defaultResourceType = "gce_instance"
+
+	maxInFlight  = 4
+	closeTimeout = 30 * time.Second
+
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+
+	loggingWriteScope = "https://www.googleapis.com/auth/logging.write"
+
+	severityError = "ERROR"
+	severityInfo  = "INFO"
 )
 
 type logStream struct {
@@ -25,7 +65,29 @@ type logStream struct {
 	hostname     string
 	instanceName string
 	zone         string
-	closed       bool
+	projectID    string
+
+	resource  logging.MonitoredResource
+	labels    map[string]string
+	parseJSON bool
+
+	batchSize     int
+	batchInterval time.Duration
+
+	queue    chan logging.Entry
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+
+	// mu guards closed, which Log consults before sending on queue so a
+	// concurrent Close can't close the channel out from under a send.
+	mu        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+
+	enqueued uint64
+	sent     uint64
+	dropped  uint64
+	retried  uint64
 }
 
 // init registers the googlelogs driver and sets the default region, if provided
@@ -45,45 +107,157 @@ func New(ctx logger.Context) (logger.Logger, error) {
 	if ctx.Config[logStreamKey] != "" {
 		logStreamName = ctx.Config[logStreamKey]
 	}
-	projID, err := metadata.ProjectID()
+	if ctx.Config[logNameKey] != "" {
+		logStreamName = ctx.Config[logNameKey]
+	}
+
+	projID := ctx.Config[projectKey]
 	if projID == "" {
-		log.Printf("Error getting project ID: %v", err)
-		return nil, err
+		id, err := metadata.ProjectID()
+		if id == "" {
+			log.Printf("Error getting project ID: %v", err)
+			return nil, err
+		}
+		projID = id
 	}
-	hc, err := google.DefaultClient(oauth2.NoContext)
+
+	hc, err := newHTTPClient(ctx.Config[credentialsKey])
 	if err != nil {
-		log.Printf("Error creating default GCE OAuth2 client: %v", err)
+		log.Printf("Error creating Google OAuth2 client: %v", err)
 		return nil, err
 	}
+
 	logClient, err := logging.NewClient(cloud.NewContext(projID, hc), projID, logStreamName)
 	if err != nil {
 		log.Printf("Error creating Google logging client: %v", err)
 		return nil, err
 	}
-	hostname, err := metadata.Hostname()
-	if hostname == "" {
-		log.Printf("Error getting hostname: %v", err)
-		return nil, err
+
+	hostname := ""
+	if h, err := metadata.Hostname(); err == nil {
+		hostname = h
 	}
-	instanceName, err := metadata.InstanceName()
-	if hostname == "" {
-		log.Printf("Error getting instance name: %v", err)
-		return nil, err
+
+	instanceName := ctx.Config[instanceNameKey]
+	if instanceName == "" {
+		if n, err := metadata.InstanceName(); err == nil {
+			instanceName = n
+		}
 	}
-	zone, err := metadata.Zone()
-	if hostname == "" {
-		log.Printf("Error getting zone: %v", err)
-		return nil, err
+
+	zone := ctx.Config[zoneKey]
+	if zone == "" {
+		if z, err := metadata.Zone(); err == nil {
+			zone = z
+		}
+	}
+
+	resourceType := ctx.Config[resourceTypeKey]
+	if resourceType == "" {
+		resourceType = defaultResourceType
+	}
+
+	batchSize := defaultBatchSize
+	if v := ctx.Config[batchSizeKey]; v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			batchSize = n
+		} else {
+			log.Printf("invalid %s %q, using default %d", batchSizeKey, v, defaultBatchSize)
+		}
+	}
+	batchInterval := defaultBatchInterval
+	if v := ctx.Config[batchIntervalKey]; v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			batchInterval = d
+		} else {
+			log.Printf("invalid %s %q, using default %s", batchIntervalKey, v, defaultBatchInterval)
+		}
+	}
+	bufferSize := defaultBufferSize
+	if v := ctx.Config[bufferSizeKey]; v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			bufferSize = n
+		} else {
+			log.Printf("invalid %s %q, using default %d", bufferSizeKey, v, defaultBufferSize)
+		}
 	}
+
 	stream := &logStream{
-		client:       *logClient,
-		hostname:     hostname,
-		instanceName: instanceName,
-		zone:         zone,
+		client:        *logClient,
+		hostname:      hostname,
+		instanceName:  instanceName,
+		zone:          zone,
+		projectID:     projID,
+		resource:      monitoredResource(resourceType, projID, instanceName, zone),
+		labels:        parseLabels(ctx.Config[labelsKey]),
+		parseJSON:     ctx.Config[parseJSONKey] == "true",
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+		queue:         make(chan logging.Entry, bufferSize),
+		inFlight:      make(chan struct{}, maxInFlight),
 	}
+	stream.wg.Add(1)
+	go stream.flusher()
 	return stream, nil
 }
 
+// newHTTPClient returns an authenticated client, preferring a
+// service-account JSON key (googlelogs-credentials) and falling back to
+// application-default credentials, which includes the metadata server
+// when running on a GCE VM with an attached service account.
+func newHTTPClient(credentialsPath string) (*http.Client, error) {
+	if credentialsPath == "" {
+		return google.DefaultClient(oauth2.NoContext)
+	}
+	data, err := ioutil.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s %q: %v", credentialsKey, credentialsPath, err)
+	}
+	config, err := google.JWTConfigFromJSON(data, loggingWriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s %q: %v", credentialsKey, credentialsPath, err)
+	}
+	return config.Client(oauth2.NoContext), nil
+}
+
+// monitoredResource builds the MonitoredResource entries are tagged with,
+// filling in whatever labels apply to resourceType.
+func monitoredResource(resourceType, projectID, instanceName, zone string) logging.MonitoredResource {
+	labels := map[string]string{"project_id": projectID}
+	switch resourceType {
+	case "gce_instance":
+		labels["instance_id"] = instanceName
+		labels["zone"] = zone
+	case "generic_node":
+		labels["node_id"] = instanceName
+		labels["location"] = zone
+	case "k8s_container":
+		labels["location"] = zone
+		labels["pod_name"] = instanceName
+	}
+	return logging.MonitoredResource{
+		Type:   resourceType,
+		Labels: labels,
+	}
+}
+
+// parseLabels parses a googlelogs-labels=k1=v1,k2=v2 log opt value into a
+// label map.
+func parseLabels(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels
+}
+
 // Name returns the name of the googlelogs logging driver
 func (l *logStream) Name() string {
 	return name
@@ -91,34 +265,230 @@ func (l *logStream) Name() string {
 
 // Log submits messages for logging by an instance of the googlelogs logging driver
 func (l *logStream) Log(msg *logger.Message) error {
+	labels := map[string]string{
+		"ContainerId": msg.ContainerID,
+		"Source":      msg.Source,
+	}
+	if l.hostname != "" {
+		labels["Hostname"] = l.hostname
+	}
+	if l.instanceName != "" {
+		labels["InstanceName"] = l.instanceName
+	}
+	if l.zone != "" {
+		labels["Zone"] = l.zone
+	}
+	for k, v := range l.labels {
+		labels[k] = v
+	}
+
+	severity := severityInfo
+	if msg.Source == "stderr" {
+		severity = severityError
+	}
+
+	var payload interface{} = msg.Line
+	if l.parseJSON {
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(msg.Line), &decoded); err == nil {
+			if s, ok := decoded["severity"].(string); ok && s != "" {
+				severity = s
+			}
+			payload = decoded
+		}
+	}
+
 	entry := logging.Entry{
-		Time: msg.Timestamp,
-		Labels: map[string]string{
-			"ContainerId":  msg.ContainerID,
-			"Source":       msg.Source,
-			"Hostname":     l.hostname,
-			"InstanceName": l.instanceName,
-			"Zone":         l.zone,
-		},
-		Payload: msg.Line,
-	}
-	if !l.closed {
-		l.client.Log(entry)
+		Time:     msg.Timestamp,
+		Severity: severity,
+		Resource: &l.resource,
+		Labels:   labels,
+		Payload:  payload,
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		atomic.AddUint64(&l.dropped, 1)
+		return nil
+	}
+
+	select {
+	case l.queue <- entry:
+		atomic.AddUint64(&l.enqueued, 1)
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		logrus.Warnf("googlelogs: buffer full, dropping log entry for container %s", msg.ContainerID)
 	}
 	return nil
 }
 
-// Close closes the instance of the googlelogs logging driver
+// flusher batches entries off the queue and flushes them to Cloud Logging
+// every batchInterval, or as soon as batchSize/maxBatchBytes is reached.
+func (l *logStream) flusher() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.batchInterval)
+	defer ticker.Stop()
+
+	var batch []logging.Entry
+	batchBytes := 0
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		l.send(batch)
+		batch = nil
+		batchBytes = 0
+	}
+
+	for {
+		select {
+		case entry, ok := <-l.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, entry)
+			batchBytes += entrySize(entry)
+			if len(batch) >= l.batchSize || batchBytes >= maxBatchBytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// entrySize estimates the wire size of an entry's payload for the
+// maxBatchBytes threshold.
+func entrySize(entry logging.Entry) int {
+	if line, ok := entry.Payload.(string); ok {
+		return len(line)
+	}
+	encoded, err := json.Marshal(entry.Payload)
+	if err != nil {
+		return 0
+	}
+	return len(encoded)
+}
+
+// send hands a batch of entries to the Cloud Logging client and flushes
+// them, retrying with exponential backoff and jitter on retryable errors.
+// It runs in its own goroutine, bounded by inFlight, so a slow or retrying
+// batch doesn't block the flusher from picking up new log lines.
+func (l *logStream) send(batch []logging.Entry) {
+	l.inFlight <- struct{}{}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		defer func() { <-l.inFlight }()
+
+		backoff := initialBackoff
+		for attempt := 0; ; attempt++ {
+			for _, entry := range batch {
+				l.client.Log(entry)
+			}
+			err := l.client.Flush()
+			if err == nil {
+				atomic.AddUint64(&l.sent, uint64(len(batch)))
+				return
+			}
+			if !isRetryable(err) || attempt >= 5 {
+				atomic.AddUint64(&l.dropped, uint64(len(batch)))
+				logrus.Errorf("googlelogs: dropping %d log entries after flush error: %v", len(batch), err)
+				return
+			}
+			atomic.AddUint64(&l.retried, uint64(len(batch)))
+			sleep := backoff + time.Duration(rand.Int63n(int64(backoff)))
+			time.Sleep(sleep)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}()
+}
+
+// isRetryable reports whether err is a transient Cloud Logging error
+// (HTTP 429/500/502/503/504, or a temporary network/transport error)
+// worth retrying. It type-asserts the structured errors the client
+// actually returns rather than pattern-matching err.Error(), which would
+// both over-match (any message that happens to contain one of these
+// digit sequences) and under-match (a retryable error whose message
+// doesn't spell out its code).
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if gerr, ok := err.(*googleapi.Error); ok {
+		switch gerr.Code {
+		case 429, 500, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+	if terr, ok := err.(interface{ Temporary() bool }); ok {
+		return terr.Temporary()
+	}
+	return false
+}
+
+// Close closes the instance of the googlelogs logging driver, draining
+// any queued entries (up to closeTimeout) before returning.
 func (l *logStream) Close() error {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		l.closed = true
+		close(l.queue)
+		l.mu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			l.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(closeTimeout):
+			logrus.Warnf("googlelogs: timed out draining log queue, %d entries may be lost", len(l.queue))
+		}
+	})
 	return nil
 }
 
 // ValidateLogOpt looks for googlelogs-specific log options
-// googlelogs-group, and googlelogs-stream
 func ValidateLogOpt(cfg map[string]string) error {
-	for key := range cfg {
+	for key, value := range cfg {
 		switch key {
 		case logStreamKey:
+		case batchSizeKey:
+			if value != "" {
+				if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+					return fmt.Errorf("%s must be a positive integer, got %q", batchSizeKey, value)
+				}
+			}
+		case batchIntervalKey:
+			if value != "" {
+				if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+					return fmt.Errorf("%s must be a positive duration, got %q", batchIntervalKey, value)
+				}
+			}
+		case bufferSizeKey:
+			if value != "" {
+				if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+					return fmt.Errorf("%s must be a positive integer, got %q", bufferSizeKey, value)
+				}
+			}
+		case logNameKey:
+		case projectKey:
+		case zoneKey:
+		case instanceNameKey:
+		case credentialsKey:
+		case resourceTypeKey:
+		case labelsKey:
+		case parseJSONKey:
 		default:
 			return fmt.Errorf("unknown log opt '%s' for %s log driver", key, name)
 		}
@@ -0,0 +1,106 @@
+package googlelogs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/cloud/logging"
+)
+
+type temporaryError struct{ temporary bool }
+
+func (e temporaryError) Error() string   { return "temporary error" }
+func (e temporaryError) Temporary() bool { return e.temporary }
+
+func TestIsRetryable(t *testing.T) {
+	if isRetryable(nil) {
+		t.Error("isRetryable(nil) = true, want false")
+	}
+	for _, code := range []int{429, 500, 502, 503, 504} {
+		if !isRetryable(&googleapi.Error{Code: code}) {
+			t.Errorf("isRetryable(googleapi.Error{Code: %d}) = false, want true", code)
+		}
+	}
+	if isRetryable(&googleapi.Error{Code: 400}) {
+		t.Error("isRetryable(googleapi.Error{Code: 400}) = true, want false")
+	}
+	if !isRetryable(temporaryError{temporary: true}) {
+		t.Error("isRetryable(temporary network error) = false, want true")
+	}
+	if isRetryable(temporaryError{temporary: false}) {
+		t.Error("isRetryable(non-temporary network error) = true, want false")
+	}
+	if isRetryable(errors.New("some other error that mentions 500 in passing")) {
+		t.Error("isRetryable should not pattern-match digits in an unstructured error string")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	cases := []struct {
+		in   string
+		want map[string]string
+	}{
+		{"", nil},
+		{"k1=v1", map[string]string{"k1": "v1"}},
+		{"k1=v1,k2=v2", map[string]string{"k1": "v1", "k2": "v2"}},
+		{"k1=v1=extra,bad,=novalue", map[string]string{"k1": "v1=extra"}},
+	}
+	for _, c := range cases {
+		if got := parseLabels(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseLabels(%q) = %#v, want %#v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestMonitoredResource(t *testing.T) {
+	r := monitoredResource("gce_instance", "proj", "inst", "zone-a")
+	if r.Type != "gce_instance" {
+		t.Errorf("Type = %q, want gce_instance", r.Type)
+	}
+	want := map[string]string{"project_id": "proj", "instance_id": "inst", "zone": "zone-a"}
+	if !reflect.DeepEqual(r.Labels, want) {
+		t.Errorf("Labels = %#v, want %#v", r.Labels, want)
+	}
+
+	r = monitoredResource("k8s_container", "proj", "pod", "zone-a")
+	want = map[string]string{"project_id": "proj", "pod_name": "pod", "location": "zone-a"}
+	if !reflect.DeepEqual(r.Labels, want) {
+		t.Errorf("Labels = %#v, want %#v", r.Labels, want)
+	}
+}
+
+func TestValidateLogOptRejectsNonPositiveValues(t *testing.T) {
+	cases := map[string]string{
+		batchSizeKey:     "-1",
+		batchIntervalKey: "-1s",
+		bufferSizeKey:    "0",
+	}
+	for key, value := range cases {
+		if err := ValidateLogOpt(map[string]string{key: value}); err == nil {
+			t.Errorf("ValidateLogOpt(%s=%s) = nil, want an error", key, value)
+		}
+	}
+}
+
+func TestValidateLogOptAcceptsValidValues(t *testing.T) {
+	cfg := map[string]string{
+		batchSizeKey:     "500",
+		batchIntervalKey: "10s",
+		bufferSizeKey:    "5000",
+	}
+	if err := ValidateLogOpt(cfg); err != nil {
+		t.Errorf("ValidateLogOpt(%#v) = %v, want nil", cfg, err)
+	}
+}
+
+func TestEntrySize(t *testing.T) {
+	// Exercised indirectly via the flusher in production; here we just
+	// confirm string payloads are measured by their raw length rather
+	// than their JSON-encoded (quoted) length.
+	entry := logging.Entry{Payload: "hello"}
+	if got := entrySize(entry); got != len("hello") {
+		t.Errorf("entrySize(string) = %d, want %d", got, len("hello"))
+	}
+}
@@ -3,6 +3,7 @@ package gce
 import (
 	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -13,15 +14,66 @@ import (
 	"code.google.com/p/goauth2/oauth"
 	"code.google.com/p/google-api-go-client/compute/v1"
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 )
 
-func newGCEService(storePath string) (*compute.Service, error) {
-	client := newOauthClient(storePath)
-	service, err := compute.New(client)
-	return service, err
+// gceScopes are the OAuth scopes requested when authenticating with a
+// service-account JSON key or application-default credentials.
+var gceScopes = []string{
+	compute.ComputeScope,
+	"https://www.googleapis.com/auth/devstorage.full_control",
+	"https://www.googleapis.com/auth/logging.write",
 }
 
-func newOauthClient(storePath string) *http.Client {
+func newGCEService(driver *Driver) (*compute.Service, error) {
+	client, err := newOauthClient(driver)
+	if err != nil {
+		return nil, err
+	}
+	return compute.New(client)
+}
+
+// newOauthClient returns an authenticated *http.Client, preferring (in
+// order) a service-account JSON key passed via --gce-auth-json, then
+// application-default credentials (e.g. the metadata service when
+// running on a GCE VM with an attached service account), and finally
+// falling back to the interactive, browser-based OAuth flow.
+func newOauthClient(driver *Driver) (*http.Client, error) {
+	if driver.authTokenPath != "" {
+		client, err := clientFromJSONKey(driver.authTokenPath)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	if client, err := google.DefaultClient(oauth2.NoContext, gceScopes...); err == nil {
+		return client, nil
+	} else {
+		log.Debugf("No application-default credentials available, falling back to interactive auth: %v", err)
+	}
+
+	return interactiveClient(driver.storePath), nil
+}
+
+// clientFromJSONKey builds an authenticated client from a service-account
+// JSON key file on disk.
+func clientFromJSONKey(keyPath string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service-account JSON key %q: %v", keyPath, err)
+	}
+	config, err := google.JWTConfigFromJSON(data, gceScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service-account JSON key %q: %v", keyPath, err)
+	}
+	return config.Client(oauth2.NoContext), nil
+}
+
+// interactiveClient runs the legacy browser-based OAuth flow, caching the
+// resulting token under storePath so subsequent runs don't need it again.
+func interactiveClient(storePath string) *http.Client {
 	config := &oauth.Config{
 		ClientId:     "22738965389-8arp8bah3uln9eoenproamovfjj1ac33.apps.googleusercontent.com",
 		ClientSecret: "qApc3amTyr5wI74vVrRWAfC_",
@@ -29,9 +81,8 @@ func newOauthClient(storePath string) *http.Client {
 		AuthURL:      "https://accounts.google.com/o/oauth2/auth",
 		TokenURL:     "https://accounts.google.com/o/oauth2/token",
 	}
-	token := token(storePath, config)
 	t := oauth.Transport{
-		Token:     token,
+		Token:     token(storePath, config),
 		Config:    config,
 		Transport: http.DefaultTransport,
 	}
@@ -3,47 +3,90 @@ package gce
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	raw "code.google.com/p/google-api-go-client/compute/v1"
+	"code.google.com/p/google-api-go-client/googleapi"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/hosts/ssh"
 )
 
 // ComputeUtil is used to wrap the raw GCE API code and store common parameters.
 type ComputeUtil struct {
-	zone         string
-	instanceName string
-	userName     string
-	project      string
-	service      *raw.Service
-	zoneURL      string
-	globalURL    string
+	zone           string
+	instanceName   string
+	userName       string
+	project        string
+	service        *raw.Service
+	zoneURL        string
+	globalURL      string
+	regionURL      string
+	dockerPort     string
+	networkName    string
+	subnetworkName string
+	useInternalIP  bool
+	openPorts      []string
+	preemptible    bool
+	machineImage   string
+	diskType       string
+	diskSize       int64
+	scopes         []string
+	tags           []string
+	address        string
+	useExisting    bool
 }
 
 const (
 	apiURL    = "https://www.googleapis.com/compute/v1/projects/"
 	imageName = "https://www.googleapis.com/compute/v1/projects/google-containers/global/images/container-vm-v20141016"
+
+	firewallRuleName  = "docker-machines"
+	firewallTargetTag = "docker-machine"
 )
 
 // NewComputeUtil creates and initializes a ComputeUtil.
 func newComputeUtil(driver *Driver) (*ComputeUtil, error) {
-	service, err := newGCEService(driver.storePath)
+	service, err := newGCEService(driver)
 	if err != nil {
 		return nil, err
 	}
 	c := ComputeUtil{
-		zone:         driver.Zone,
-		instanceName: driver.InstanceName,
-		userName:     driver.UserName,
-		project:      driver.Project,
-		service:      service,
-		zoneURL:      apiURL + driver.Project + "/zones/" + driver.Zone,
-		globalURL:    apiURL + driver.Project + "/global",
+		zone:           driver.Zone,
+		instanceName:   driver.InstanceName,
+		userName:       driver.UserName,
+		project:        driver.Project,
+		service:        service,
+		zoneURL:        apiURL + driver.Project + "/zones/" + driver.Zone,
+		globalURL:      apiURL + driver.Project + "/global",
+		regionURL:      apiURL + driver.Project + "/regions/" + region(driver.Zone),
+		dockerPort:     driver.DockerPort,
+		networkName:    driver.Network,
+		subnetworkName: driver.Subnetwork,
+		useInternalIP:  driver.UseInternalIP,
+		openPorts:      driver.OpenPorts,
+		preemptible:    driver.Preemptible,
+		machineImage:   driver.MachineImage,
+		diskType:       driver.DiskType,
+		diskSize:       driver.DiskSize,
+		scopes:         driver.Scopes,
+		tags:           driver.Tags,
+		address:        driver.Address,
+		useExisting:    driver.UseExisting,
 	}
 	return &c, nil
 }
 
+// region derives the GCE region (e.g. "us-central1") from a zone name
+// (e.g. "us-central1-a").
+func region(zone string) string {
+	parts := strings.Split(zone, "-")
+	if len(parts) < 2 {
+		return zone
+	}
+	return strings.Join(parts[:len(parts)-1], "-")
+}
+
 func (c *ComputeUtil) diskName() string {
 	return c.instanceName + "-disk"
 }
@@ -56,9 +99,15 @@ func (c *ComputeUtil) disk() (*raw.Disk, error) {
 // createDisk creates a persistent disk.
 func (c *ComputeUtil) createDisk() error {
 	log.Infof("Creating disk")
+	machineImage := c.machineImage
+	if machineImage == "" {
+		machineImage = imageName
+	}
 	op, err := c.service.Disks.Insert(c.project, c.zone, &raw.Disk{
-		Name: c.diskName(),
-	}).SourceImage(imageName).Do()
+		Name:   c.diskName(),
+		Type:   c.zoneURL + "/diskTypes/" + c.diskType,
+		SizeGb: c.diskSize,
+	}).SourceImage(machineImage).Do()
 	if err != nil {
 		return err
 	}
@@ -82,51 +131,166 @@ func (c *ComputeUtil) instance() (*raw.Instance, error) {
 	return c.service.Instances.Get(c.project, c.zone, c.instanceName).Do()
 }
 
-// createInstance creates a GCE VM instance.
+// network returns the normalized network name to attach instances and
+// firewall rules to, defaulting to "default".
+func (c *ComputeUtil) network() string {
+	if c.networkName == "" {
+		return "default"
+	}
+	return c.networkName
+}
+
+// networkInterface builds the NetworkInterface attached to created
+// instances, honoring the configured network, subnetwork, useInternalIP
+// and static address settings.
+func (c *ComputeUtil) networkInterface() (*raw.NetworkInterface, error) {
+	iface := &raw.NetworkInterface{
+		Network: c.globalURL + "/networks/" + c.network(),
+	}
+	if c.subnetworkName != "" {
+		iface.Subnetwork = c.regionURL + "/subnetworks/" + c.subnetworkName
+	}
+	if !c.useInternalIP {
+		accessConfig := &raw.AccessConfig{Type: "ONE_TO_ONE_NAT"}
+		if c.address != "" {
+			natIP, err := c.staticAddress()
+			if err != nil {
+				return nil, err
+			}
+			accessConfig.NatIP = natIP
+		}
+		iface.AccessConfigs = []*raw.AccessConfig{accessConfig}
+	}
+	return iface, nil
+}
+
+// staticAddress resolves the reserved external IP named by c.address in
+// the instance's region.
+func (c *ComputeUtil) staticAddress() (string, error) {
+	addr, err := c.service.Addresses.Get(c.project, region(c.zone), c.address).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve static address %q: %v", c.address, err)
+	}
+	return addr.Address, nil
+}
+
+// serviceAccounts builds the default service account attached to created
+// instances, granting the configured OAuth scopes.
+func (c *ComputeUtil) serviceAccounts() []*raw.ServiceAccount {
+	if len(c.scopes) == 0 {
+		return nil
+	}
+	return []*raw.ServiceAccount{
+		{Email: "default", Scopes: c.scopes},
+	}
+}
+
+// mergeInstanceTags returns the *raw.Tags to apply to instance so it
+// includes tag, or nil if tag is already present and nothing needs to
+// change. It contains no API calls so it can be exercised directly in
+// tests.
+func mergeInstanceTags(instance *raw.Instance, tag string) *raw.Tags {
+	items := []string{}
+	fingerprint := ""
+	if instance.Tags != nil {
+		for _, t := range instance.Tags.Items {
+			if t == tag {
+				return nil
+			}
+		}
+		items = instance.Tags.Items
+		fingerprint = instance.Tags.Fingerprint
+	}
+	return &raw.Tags{
+		Items:       append(items, tag),
+		Fingerprint: fingerprint,
+	}
+}
+
+// ensureFirewallTag adds firewallTargetTag to instance if it's not already
+// present, so an adopted (--gce-use-existing) instance actually gets
+// covered by the firewall rule openFirewallPorts creates/patches for it,
+// the same as a freshly-created instance.
+func (c *ComputeUtil) ensureFirewallTag(instance *raw.Instance) error {
+	tags := mergeInstanceTags(instance, firewallTargetTag)
+	if tags == nil {
+		return nil
+	}
+
+	log.Infof("Tagging existing instance for firewall access.")
+	op, err := c.service.Instances.SetTags(c.project, c.zone, c.instanceName, tags).Do()
+	if err != nil {
+		return err
+	}
+	return c.waitForOp(op.Name)
+}
+
+// createInstance creates a GCE VM instance, or adopts one that already
+// exists when useExisting is set.
 func (c *ComputeUtil) createInstance(publicSSHKeyPath, sshKeyPath, machineType string) error {
-	log.Infof("Creating instance.")
+	var op *raw.Operation
+
 	disk, err := c.disk()
 	if disk == nil {
 		if err := c.createDisk(); err != nil {
 			return err
 		}
 	}
-	op, err := c.service.Instances.Insert(c.project, c.zone, &raw.Instance{
-		Name:        c.instanceName,
-		Description: "docker host vm",
-		MachineType: c.zoneURL + "/machineTypes/" + machineType,
-		Disks: []*raw.AttachedDisk{
-			{
-				Boot:       true,
-				AutoDelete: false,
-				Type:       "PERSISTENT",
-				Mode:       "READ_WRITE",
-				Source:     c.zoneURL + "/disks/" + c.instanceName + "-disk",
+	if err := c.openFirewallPorts(); err != nil {
+		return err
+	}
+
+	existing, _ := c.instance()
+	if existing == nil {
+		log.Infof("Creating instance.")
+		iface, err := c.networkInterface()
+		if err != nil {
+			return err
+		}
+		op, err = c.service.Instances.Insert(c.project, c.zone, &raw.Instance{
+			Name:        c.instanceName,
+			Description: "docker host vm",
+			MachineType: c.zoneURL + "/machineTypes/" + machineType,
+			Tags: &raw.Tags{
+				Items: append([]string{firewallTargetTag}, c.tags...),
 			},
-		},
-		NetworkInterfaces: []*raw.NetworkInterface{
-			{
-				AccessConfigs: []*raw.AccessConfig{
-					&raw.AccessConfig{Type: "ONE_TO_ONE_NAT"},
+			Disks: []*raw.AttachedDisk{
+				{
+					Boot:       true,
+					AutoDelete: false,
+					Type:       "PERSISTENT",
+					Mode:       "READ_WRITE",
+					Source:     c.zoneURL + "/disks/" + c.instanceName + "-disk",
 				},
-				Network: c.globalURL + "/networks/default",
 			},
-		},
-	}).Do()
+			NetworkInterfaces: []*raw.NetworkInterface{iface},
+			ServiceAccounts:   c.serviceAccounts(),
+			Scheduling: &raw.Scheduling{
+				Preemptible: c.preemptible,
+			},
+		}).Do()
 
-	if err != nil {
-		return err
-	}
-	log.Infof("Waiting for Instance...")
-	if err = c.waitForOp(op.Name); err != nil {
-		return err
+		if err != nil {
+			return err
+		}
+		log.Infof("Waiting for Instance...")
+		if err = c.waitForOp(op.Name); err != nil {
+			return err
+		}
+	} else if !c.useExisting {
+		return fmt.Errorf("Instance %v already exists.", c.instanceName)
+	} else {
+		log.Infof("Adopting existing instance.")
+		if err := c.ensureFirewallTag(existing); err != nil {
+			return err
+		}
 	}
 
 	instance, err := c.instance()
 	if err != nil {
 		return err
 	}
-	ip := instance.NetworkInterfaces[0].AccessConfigs[0].NatIP
+	ip := c.ipFromInstance(instance)
 	c.waitForSSH(ip)
 
 	// Update the SSH Key
@@ -153,12 +317,8 @@ func (c *ComputeUtil) createInstance(publicSSHKeyPath, sshKeyPath, machineType s
 		return err
 	}
 
-	if err := c.configureInstance(ip, sshKeyPath); err != nil {
-		return err
-	}
-
-	// Configure Docker
-	return c.updateDocker(ip, sshKeyPath)
+	log.Infof("Provisioning Docker.")
+	return c.configureInstance(ip, sshKeyPath)
 }
 
 // deleteInstance deletes the instance, leaving the persistent disk.
@@ -172,35 +332,39 @@ func (c *ComputeUtil) deleteInstance() error {
 	return c.waitForOp(op.Name)
 }
 
-// configureInstance prepares the instance for docker usage.
+// daemonOpts builds the DaemonOpts a Provisioner should configure the
+// instance's Docker daemon with.
+func (c *ComputeUtil) daemonOpts() DaemonOpts {
+	return DaemonOpts{
+		BindHost: "0.0.0.0",
+		BindPort: c.dockerPort,
+	}
+}
+
+// configureInstance detects the instance's base OS and uses the matching
+// Provisioner to install and configure Docker on it.
 func (c *ComputeUtil) configureInstance(ip, sshKeyPath string) error {
-	log.Infof("Setting up instance.")
-	commands := []string{
-		"sudo sed -i 's/DOCKER_OPTS=.*/DOCKER_OPTS=\"-H 0.0.0.0:2375\"/g' /etc/default/docker",
-		"sudo service docker restart"}
-	return c.executeCommands(commands, ip, sshKeyPath)
+	provisioner, err := detectProvisioner(c.userName, ip, sshKeyPath)
+	if err != nil {
+		return err
+	}
+	if err := provisioner.InstallDocker(ip, sshKeyPath); err != nil {
+		return err
+	}
+	if err := provisioner.ConfigureDaemon(ip, sshKeyPath, c.daemonOpts()); err != nil {
+		return err
+	}
+	return provisioner.RestartDocker(ip, sshKeyPath)
 }
 
-// updateDocker updates the docker daemon to the latest version.
+// updateDocker upgrades the docker daemon on the instance to the latest
+// version, via the Provisioner matching its base OS.
 func (c *ComputeUtil) updateDocker(ip, sshKeyPath string) error {
-	log.Infof("Updating docker.")
-	commands := []string{
-		"sudo service docker stop",
-		"sleep 10",
-		"sudo wget https://get.docker.com/builds/Linux/x86_64/docker-latest -O /usr/bin/docker && sudo chmod +x /usr/bin/docker",
-		"sudo service docker start"}
-	return c.executeCommands(commands, ip, sshKeyPath)
-}
-
-func (c *ComputeUtil) executeCommands(commands []string, ip, sshKeyPath string) error {
-	for _, command := range commands {
-		log.Debugf("Running command: %v", command)
-		cmd := ssh.GetSSHCommand(ip, 22, c.userName, sshKeyPath, command)
-		if err := cmd.Run(); err != nil {
-			return err
-		}
+	provisioner, err := detectProvisioner(c.userName, ip, sshKeyPath)
+	if err != nil {
+		return err
 	}
-	return nil
+	return provisioner.UpgradeDocker(ip, sshKeyPath)
 }
 
 // waitForOp waits for the GCE Operation to finish.
@@ -229,11 +393,194 @@ func (c *ComputeUtil) waitForSSH(ip string) error {
 	return ssh.WaitForTCP(fmt.Sprintf("%s:22", ip))
 }
 
-// ip retrieves and returns the external IP address of the instance.
+// ip retrieves and returns the IP address of the instance, preferring the
+// internal IP when useInternalIP is set.
 func (c *ComputeUtil) ip() (string, error) {
 	instance, err := c.service.Instances.Get(c.project, c.zone, c.instanceName).Do()
 	if err != nil {
 		return "", err
 	}
-	return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP, nil
+	return c.ipFromInstance(instance), nil
+}
+
+// ipFromInstance returns the internal or external IP of an already-fetched
+// instance, depending on useInternalIP.
+func (c *ComputeUtil) ipFromInstance(instance *raw.Instance) string {
+	iface := instance.NetworkInterfaces[0]
+	if c.useInternalIP {
+		return iface.NetworkIP
+	}
+	return iface.AccessConfigs[0].NatIP
+}
+
+// firewallRuleName returns the name of the firewall rule shared by
+// docker-machine instances on this instance's network. The rule is scoped
+// per-network so that instances created with different --gce-network
+// values don't fight over (or silently miss out on) each other's rule.
+func (c *ComputeUtil) firewallRuleName() string {
+	return firewallRuleName + "-" + c.network()
+}
+
+// firewallRule retrieves this network's shared docker-machines firewall
+// rule, if it exists.
+func (c *ComputeUtil) firewallRule() (*raw.Firewall, error) {
+	return c.service.Firewalls.Get(c.project, c.firewallRuleName()).Do()
+}
+
+// isNotFound reports whether err is a "not found" response from the GCE
+// API, as opposed to some other failure (permission denied, network
+// error, wrong project, ...) that happens to also prevent a lookup from
+// succeeding.
+func isNotFound(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code == 404
+}
+
+// mergeFirewallRule unions ports and tag into rule's allowed TCP ports and
+// target tags in place, reporting whether anything changed. It contains no
+// API calls so it can be exercised directly in tests.
+func mergeFirewallRule(rule *raw.Firewall, ports []string, tag string) bool {
+	existingPorts := map[string]bool{}
+	for _, allowed := range rule.Allowed {
+		for _, p := range allowed.Ports {
+			existingPorts[p] = true
+		}
+	}
+	changed := false
+	for _, p := range ports {
+		if !existingPorts[p] {
+			existingPorts[p] = true
+			changed = true
+		}
+	}
+	hasTag := false
+	for _, t := range rule.TargetTags {
+		if t == tag {
+			hasTag = true
+		}
+	}
+	if !hasTag {
+		rule.TargetTags = append(rule.TargetTags, tag)
+		changed = true
+	}
+	if !changed {
+		return false
+	}
+
+	allPorts := make([]string, 0, len(existingPorts))
+	for p := range existingPorts {
+		allPorts = append(allPorts, p)
+	}
+	rule.Allowed = []*raw.FirewallAllowed{{IPProtocol: "tcp", Ports: allPorts}}
+	return true
+}
+
+// openFirewallPorts creates this network's docker-machines firewall rule
+// if it doesn't exist, or patches it to union in any ports/tags this
+// instance needs, so multiple docker-machine instances on the same
+// network can share it.
+func (c *ComputeUtil) openFirewallPorts() error {
+	ports := append([]string{c.dockerPort}, c.openPorts...)
+	name := c.firewallRuleName()
+	networkURL := c.globalURL + "/networks/" + c.network()
+
+	rule, err := c.firewallRule()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("unable to look up firewall rule %q: %v", name, err)
+	}
+	if err != nil {
+		log.Infof("Creating firewall rule for %s.", name)
+		op, err := c.service.Firewalls.Insert(c.project, &raw.Firewall{
+			Name:    name,
+			Network: networkURL,
+			Allowed: []*raw.FirewallAllowed{
+				{IPProtocol: "tcp", Ports: ports},
+			},
+			TargetTags: []string{firewallTargetTag},
+		}).Do()
+		if err != nil {
+			return err
+		}
+		return c.waitForGlobalOp(op.Name)
+	}
+
+	if rule.Network != networkURL {
+		return fmt.Errorf("firewall rule %q already exists for network %q, not %q; use a different --gce-network or remove the existing rule", name, rule.Network, networkURL)
+	}
+
+	if !mergeFirewallRule(rule, ports, firewallTargetTag) {
+		return nil
+	}
+
+	log.Infof("Updating firewall rule %s.", name)
+	op, err := c.service.Firewalls.Patch(c.project, name, rule).Do()
+	if err != nil {
+		return err
+	}
+	return c.waitForGlobalOp(op.Name)
+}
+
+// deleteFirewallRule tears down this network's docker-machines firewall
+// rule, but only once no other docker-machine-tagged instances on this
+// network remain in the project, so it stays around as long as other
+// machines need it.
+func (c *ComputeUtil) deleteFirewallRule() error {
+	name := c.firewallRuleName()
+	if _, err := c.firewallRule(); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to look up firewall rule %q: %v", name, err)
+	}
+
+	aggregated, err := c.service.Instances.AggregatedList(c.project).Do()
+	if err != nil {
+		return err
+	}
+	networkURL := c.globalURL + "/networks/" + c.network()
+	for _, instancesInZone := range aggregated.Items {
+		for _, instance := range instancesInZone.Instances {
+			if instance.Name == c.instanceName {
+				continue
+			}
+			if len(instance.NetworkInterfaces) == 0 || instance.NetworkInterfaces[0].Network != networkURL {
+				continue
+			}
+			if instance.Tags == nil {
+				continue
+			}
+			for _, tag := range instance.Tags.Items {
+				if tag == firewallTargetTag {
+					return nil
+				}
+			}
+		}
+	}
+
+	log.Infof("Removing firewall rule %s.", name)
+	op, err := c.service.Firewalls.Delete(c.project, name).Do()
+	if err != nil {
+		return err
+	}
+	return c.waitForGlobalOp(op.Name)
+}
+
+// waitForGlobalOp waits for a global GCE operation (e.g. a firewall
+// change) to finish.
+func (c *ComputeUtil) waitForGlobalOp(name string) error {
+	for {
+		op, err := c.service.GlobalOperations.Get(c.project, name).Do()
+		if err != nil {
+			return err
+		}
+		log.Debugf("operation %q status: %s", op.Name, op.Status)
+		if op.Status == "DONE" {
+			if op.Error != nil {
+				return fmt.Errorf("Operation error: %v", *op.Error.Errors[0])
+			}
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return nil
 }
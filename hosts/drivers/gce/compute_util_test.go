@@ -0,0 +1,141 @@
+package gce
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	raw "code.google.com/p/google-api-go-client/compute/v1"
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+func TestRegion(t *testing.T) {
+	cases := map[string]string{
+		"us-central1-a":  "us-central1",
+		"europe-west1-b": "europe-west1",
+		"asia-east1-c":   "asia-east1",
+		"noregion":       "noregion",
+	}
+	for zone, want := range cases {
+		if got := region(zone); got != want {
+			t.Errorf("region(%q) = %q, want %q", zone, got, want)
+		}
+	}
+}
+
+func TestMergeFirewallRuleAddsNewPortsAndTag(t *testing.T) {
+	rule := &raw.Firewall{
+		Allowed: []*raw.FirewallAllowed{
+			{IPProtocol: "tcp", Ports: []string{"2375"}},
+		},
+		TargetTags: []string{},
+	}
+
+	changed := mergeFirewallRule(rule, []string{"2375", "8080"}, firewallTargetTag)
+	if !changed {
+		t.Fatal("mergeFirewallRule() = false, want true")
+	}
+
+	var ports []string
+	for _, allowed := range rule.Allowed {
+		ports = append(ports, allowed.Ports...)
+	}
+	sort.Strings(ports)
+	if want := []string{"2375", "8080"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("ports = %#v, want %#v", ports, want)
+	}
+	if !reflect.DeepEqual(rule.TargetTags, []string{firewallTargetTag}) {
+		t.Errorf("TargetTags = %#v, want [%s]", rule.TargetTags, firewallTargetTag)
+	}
+}
+
+func TestMergeFirewallRuleNoopWhenAlreadyPresent(t *testing.T) {
+	rule := &raw.Firewall{
+		Allowed: []*raw.FirewallAllowed{
+			{IPProtocol: "tcp", Ports: []string{"2375", "8080"}},
+		},
+		TargetTags: []string{firewallTargetTag},
+	}
+
+	if changed := mergeFirewallRule(rule, []string{"2375"}, firewallTargetTag); changed {
+		t.Fatal("mergeFirewallRule() = true, want false when nothing new is added")
+	}
+}
+
+func TestDiskName(t *testing.T) {
+	c := &ComputeUtil{instanceName: "docker-host"}
+	if got, want := c.diskName(), "docker-host-disk"; got != want {
+		t.Errorf("diskName() = %q, want %q", got, want)
+	}
+}
+
+func TestServiceAccountsNoScopes(t *testing.T) {
+	c := &ComputeUtil{}
+	if got := c.serviceAccounts(); got != nil {
+		t.Errorf("serviceAccounts() = %#v, want nil", got)
+	}
+}
+
+func TestServiceAccountsWithScopes(t *testing.T) {
+	c := &ComputeUtil{scopes: []string{"scope-a", "scope-b"}}
+	got := c.serviceAccounts()
+	want := []*raw.ServiceAccount{
+		{Email: "default", Scopes: []string{"scope-a", "scope-b"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceAccounts() = %#v, want %#v", got, want)
+	}
+}
+
+func TestMergeInstanceTagsAddsTag(t *testing.T) {
+	instance := &raw.Instance{
+		Tags: &raw.Tags{Items: []string{"existing-tag"}, Fingerprint: "abc"},
+	}
+	tags := mergeInstanceTags(instance, firewallTargetTag)
+	if tags == nil {
+		t.Fatal("mergeInstanceTags() = nil, want non-nil")
+	}
+	if tags.Fingerprint != "abc" {
+		t.Errorf("Fingerprint = %q, want %q", tags.Fingerprint, "abc")
+	}
+	want := []string{"existing-tag", firewallTargetTag}
+	if !reflect.DeepEqual(tags.Items, want) {
+		t.Errorf("Items = %#v, want %#v", tags.Items, want)
+	}
+}
+
+func TestMergeInstanceTagsNoopWhenAlreadyTagged(t *testing.T) {
+	instance := &raw.Instance{
+		Tags: &raw.Tags{Items: []string{firewallTargetTag}},
+	}
+	if tags := mergeInstanceTags(instance, firewallTargetTag); tags != nil {
+		t.Errorf("mergeInstanceTags() = %#v, want nil when tag is already present", tags)
+	}
+}
+
+func TestMergeInstanceTagsHandlesNilTags(t *testing.T) {
+	instance := &raw.Instance{}
+	tags := mergeInstanceTags(instance, firewallTargetTag)
+	if tags == nil {
+		t.Fatal("mergeInstanceTags() = nil, want non-nil")
+	}
+	if want := []string{firewallTargetTag}; !reflect.DeepEqual(tags.Items, want) {
+		t.Errorf("Items = %#v, want %#v", tags.Items, want)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	if isNotFound(nil) {
+		t.Error("isNotFound(nil) = true, want false")
+	}
+	if isNotFound(errors.New("permission denied")) {
+		t.Error("isNotFound on a plain error = true, want false")
+	}
+	if isNotFound(&googleapi.Error{Code: 403}) {
+		t.Error("isNotFound(403) = true, want false")
+	}
+	if !isNotFound(&googleapi.Error{Code: 404}) {
+		t.Error("isNotFound(404) = false, want true")
+	}
+}
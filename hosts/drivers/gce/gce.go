@@ -9,11 +9,13 @@ import (
 	"os/exec"
 	"path"
 	"runtime"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/hosts/drivers"
 	"github.com/docker/docker/hosts/ssh"
 	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/docker/docker/pkg/opts"
 )
 
 // Driver is a struct compatible with the docker.hosts.drivers.Driver interface.
@@ -26,15 +28,43 @@ type Driver struct {
 	Project          string
 	sshKeyPath       string
 	publicSSHKeyPath string
+	authTokenPath    string
+	DockerPort       string
+	Network          string
+	Subnetwork       string
+	UseInternalIP    bool
+	OpenPorts        []string
+	Preemptible      bool
+	MachineImage     string
+	DiskType         string
+	DiskSize         int64
+	Scopes           []string
+	Tags             []string
+	Address          string
+	UseExisting      bool
 }
 
 // CreateFlags are the command line flags used to create a driver.
 type CreateFlags struct {
-	InstanceName *string
-	Zone         *string
-	MachineType  *string
-	UserName     *string
-	Project      *string
+	InstanceName  *string
+	Zone          *string
+	MachineType   *string
+	UserName      *string
+	Project       *string
+	AuthJSON      *string
+	DockerPort    *string
+	Network       *string
+	Subnetwork    *string
+	UseInternalIP *bool
+	OpenPorts     *opts.ListOpts
+	Preemptible   *bool
+	MachineImage  *string
+	DiskType      *string
+	DiskSize      *int64
+	Scopes        *string
+	Tags          *string
+	Address       *string
+	UseExisting   *bool
 }
 
 func init() {
@@ -74,6 +104,73 @@ func RegisterCreateFlags(cmd *flag.FlagSet) interface{} {
 		"",
 		"GCE Project name",
 	)
+	createFlags.AuthJSON = cmd.String(
+		[]string{"-gce-auth-json"},
+		os.Getenv("GCE_AUTH_JSON"),
+		"Path to a GCE service-account JSON key file to use instead of the interactive OAuth flow",
+	)
+	createFlags.DockerPort = cmd.String(
+		[]string{"-gce-docker-port"},
+		"2375",
+		"Port the Docker daemon listens on and is opened on the firewall",
+	)
+	createFlags.Network = cmd.String(
+		[]string{"-gce-network"},
+		"default",
+		"GCE network to attach the instance to",
+	)
+	createFlags.Subnetwork = cmd.String(
+		[]string{"-gce-subnetwork"},
+		"",
+		"GCE subnetwork to attach the instance to, if the network is in custom subnet mode",
+	)
+	createFlags.UseInternalIP = cmd.Bool(
+		[]string{"-gce-use-internal-ip"},
+		false,
+		"Use the instance's internal IP instead of requesting an external one",
+	)
+	createFlags.OpenPorts = opts.NewListOpts(nil)
+	cmd.Var(createFlags.OpenPorts, []string{"-gce-open-port"}, "Additional TCP port(s) to open on the firewall for this instance (can be specified multiple times)")
+	createFlags.Preemptible = cmd.Bool(
+		[]string{"-gce-preemptible"},
+		false,
+		"Use a preemptible GCE instance",
+	)
+	createFlags.MachineImage = cmd.String(
+		[]string{"-gce-machine-image"},
+		imageName,
+		"GCE machine image to use for the instance's boot disk",
+	)
+	createFlags.DiskType = cmd.String(
+		[]string{"-gce-disk-type"},
+		"pd-standard",
+		"GCE disk type for the instance's boot disk (pd-standard or pd-ssd)",
+	)
+	createFlags.DiskSize = cmd.Int64(
+		[]string{"-gce-disk-size"},
+		10,
+		"Size in GB of the instance's boot disk",
+	)
+	createFlags.Scopes = cmd.String(
+		[]string{"-gce-scopes"},
+		"",
+		"Comma-separated list of OAuth scopes to grant the instance's default service account",
+	)
+	createFlags.Tags = cmd.String(
+		[]string{"-gce-tags"},
+		"",
+		"Comma-separated list of network tags to apply to the instance",
+	)
+	createFlags.Address = cmd.String(
+		[]string{"-gce-address"},
+		"",
+		"Name of a reserved static external IP address to assign to the instance",
+	)
+	createFlags.UseExisting = cmd.Bool(
+		[]string{"-gce-use-existing"},
+		false,
+		"Adopt a pre-existing instance/disk instead of failing when one already exists",
+	)
 	return createFlags
 }
 
@@ -111,10 +208,40 @@ func (driver *Driver) SetConfigFromFlags(flagsInterface interface{}) error {
 		return fmt.Errorf("Please specify the GCE Project name using the option --gce-project.")
 	}
 	driver.Project = *flags.Project
+	driver.authTokenPath = *flags.AuthJSON
+	driver.DockerPort = *flags.DockerPort
+	driver.Network = *flags.Network
+	driver.Subnetwork = *flags.Subnetwork
+	driver.UseInternalIP = *flags.UseInternalIP
+	driver.OpenPorts = flags.OpenPorts.GetAll()
+	driver.Preemptible = *flags.Preemptible
+	driver.MachineImage = *flags.MachineImage
+	driver.DiskType = *flags.DiskType
+	driver.DiskSize = *flags.DiskSize
+	driver.Scopes = splitAndTrim(*flags.Scopes)
+	driver.Tags = splitAndTrim(*flags.Tags)
+	driver.Address = *flags.Address
+	driver.UseExisting = *flags.UseExisting
 
 	return nil
 }
 
+// splitAndTrim splits a comma-separated flag value into its parts,
+// dropping any empty entries.
+func splitAndTrim(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
 func (driver *Driver) initApis() (*ComputeUtil, error) {
 	return newComputeUtil(driver)
 }
@@ -129,7 +256,10 @@ func (driver *Driver) Create() error {
 	// Check if the instance already exists.
 	instance, _ := c.instance()
 	if instance != nil {
-		return fmt.Errorf("Instance %v already exists.", driver.InstanceName)
+		if !driver.UseExisting {
+			return fmt.Errorf("Instance %v already exists.", driver.InstanceName)
+		}
+		log.Infof("Instance %v already exists, adopting it.", driver.InstanceName)
 	}
 
 	log.Infof("Generating SSH Key")
@@ -146,7 +276,7 @@ func (driver *Driver) GetURL() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	url := fmt.Sprintf("tcp://%s:2375", ip)
+	url := fmt.Sprintf("tcp://%s:%s", ip, driver.DockerPort)
 	return url, nil
 }
 
@@ -209,12 +339,19 @@ func (driver *Driver) Stop() error {
 	return c.deleteInstance()
 }
 
-// Remove deletes the GCE instance and the disk.
+// Remove deletes the GCE instance and the disk. When --gce-use-existing
+// is set, it leaves the instance and disk intact and only tears down the
+// firewall rule; this holds whether Create adopted a pre-existing
+// instance or created a new one, since only the flag is consulted.
 func (driver *Driver) Remove() error {
 	c, err := newComputeUtil(driver)
 	if err != nil {
 		return err
 	}
+	if driver.UseExisting {
+		log.Warnf("Instance %v was set up with --gce-use-existing; leaving the instance and disk intact. Delete them yourself if that's what you want.", driver.InstanceName)
+		return c.deleteFirewallRule()
+	}
 	s, err := driver.GetState()
 	if err != nil {
 		return err
@@ -225,6 +362,9 @@ func (driver *Driver) Remove() error {
 			log.Errorf("Error deleting instance: %v", err)
 		}
 	}
+	if err := c.deleteFirewallRule(); err != nil {
+		log.Errorf("Error tearing down firewall rule: %v", err)
+	}
 	return c.deleteDisk()
 }
 
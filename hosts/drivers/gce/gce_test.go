@@ -0,0 +1,23 @@
+package gce
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitAndTrim(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a,b,c", []string{"a", "b", "c"}},
+		{" a , b ,, c ", []string{"a", "b", "c"}},
+	}
+	for _, c := range cases {
+		if got := splitAndTrim(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitAndTrim(%q) = %#v, want %#v", c.in, got, c.want)
+		}
+	}
+}
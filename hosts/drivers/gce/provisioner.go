@@ -0,0 +1,258 @@
+package gce
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/hosts/ssh"
+)
+
+// DaemonOpts carries the configuration needed to (re)configure the Docker
+// daemon on a provisioned host.
+type DaemonOpts struct {
+	BindHost   string
+	BindPort   string
+	TLSCACert  string
+	TLSCert    string
+	TLSKey     string
+	ExtraFlags []string
+}
+
+// flags renders the daemon flags these options imply, for use in whatever
+// config format a given Provisioner needs (a systemd drop-in, DOCKER_OPTS,
+// etc).
+func (o DaemonOpts) flags() string {
+	flags := []string{fmt.Sprintf("-H %s:%s", o.BindHost, o.BindPort)}
+	if o.TLSCACert != "" {
+		flags = append(flags,
+			"--tlsverify",
+			"--tlscacert="+o.TLSCACert,
+			"--tlscert="+o.TLSCert,
+			"--tlskey="+o.TLSKey,
+		)
+	}
+	flags = append(flags, o.ExtraFlags...)
+	return strings.Join(flags, " ")
+}
+
+// Provisioner configures a freshly-created instance for Docker usage.
+// Implementations exist per base OS, since the package manager, service
+// manager and daemon config layout all differ.
+type Provisioner interface {
+	// Detect reports whether this Provisioner applies to the instance at
+	// ip. It returns an error when that can't be determined (e.g. an SSH
+	// connectivity or auth failure), which callers must not treat as "no".
+	Detect(ip, sshKeyPath string) (bool, error)
+	InstallDocker(ip, sshKeyPath string) error
+	ConfigureDaemon(ip, sshKeyPath string, opts DaemonOpts) error
+	RestartDocker(ip, sshKeyPath string) error
+	UpgradeDocker(ip, sshKeyPath string) error
+}
+
+// sshRunner runs shell commands on a provisioned instance as userName,
+// shared by every Provisioner implementation below.
+type sshRunner struct {
+	userName string
+}
+
+func (r sshRunner) run(ip, sshKeyPath, command string) (string, error) {
+	cmd := ssh.GetSSHCommand(ip, 22, r.userName, sshKeyPath, command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (r sshRunner) runAll(ip, sshKeyPath string, commands []string) error {
+	for _, command := range commands {
+		log.Debugf("Running command: %v", command)
+		if _, err := r.run(ip, sshKeyPath, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// osRelease fetches /etc/os-release from the instance. It returns ("", nil)
+// when the file genuinely doesn't exist (e.g. the legacy container-vm image
+// has no such file), and a non-nil error for anything else, so a transient
+// SSH failure while probing isn't silently misread as "this is a
+// container-vm instance".
+func (r sshRunner) osRelease(ip, sshKeyPath string) (string, error) {
+	out, err := r.run(ip, sshKeyPath, "cat /etc/os-release")
+	if err == nil {
+		return out, nil
+	}
+	if isFileNotFound(err) {
+		return "", nil
+	}
+	return "", err
+}
+
+// isFileNotFound reports whether err looks like the remote shell reporting
+// a missing file, as opposed to an SSH-level connectivity or auth failure.
+func isFileNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "No such file or directory")
+}
+
+// debianProvisioner handles Debian/Ubuntu hosts via apt and a systemd
+// drop-in under /etc/systemd/system/docker.service.d.
+type debianProvisioner struct {
+	sshRunner
+}
+
+func (p *debianProvisioner) Detect(ip, sshKeyPath string) (bool, error) {
+	release, err := p.osRelease(ip, sshKeyPath)
+	if err != nil {
+		return false, err
+	}
+	return isDebianRelease(release), nil
+}
+
+// isDebianRelease reports whether the contents of /etc/os-release
+// identify a Debian or Ubuntu host.
+func isDebianRelease(release string) bool {
+	return strings.Contains(release, "ID=debian") || strings.Contains(release, "ID=ubuntu")
+}
+
+func (p *debianProvisioner) InstallDocker(ip, sshKeyPath string) error {
+	return p.runAll(ip, sshKeyPath, []string{
+		"curl -sSL https://get.docker.com/ | sudo sh",
+	})
+}
+
+func (p *debianProvisioner) ConfigureDaemon(ip, sshKeyPath string, opts DaemonOpts) error {
+	return p.runAll(ip, sshKeyPath, []string{
+		"sudo mkdir -p /etc/systemd/system/docker.service.d",
+		fmt.Sprintf(
+			"printf '[Service]\\nExecStart=\\nExecStart=/usr/bin/dockerd %s\\n' | sudo tee /etc/systemd/system/docker.service.d/10-machine.conf",
+			opts.flags(),
+		),
+		"sudo systemctl daemon-reload",
+	})
+}
+
+func (p *debianProvisioner) RestartDocker(ip, sshKeyPath string) error {
+	return p.runAll(ip, sshKeyPath, []string{"sudo systemctl restart docker"})
+}
+
+func (p *debianProvisioner) UpgradeDocker(ip, sshKeyPath string) error {
+	return p.runAll(ip, sshKeyPath, []string{
+		"sudo systemctl stop docker",
+		"curl -sSL https://get.docker.com/ | sudo sh",
+		"sudo systemctl start docker",
+	})
+}
+
+// coreOSProvisioner handles CoreOS hosts, which ship Docker already and
+// only need a systemd unit override to pick up daemon flags.
+type coreOSProvisioner struct {
+	sshRunner
+}
+
+func (p *coreOSProvisioner) Detect(ip, sshKeyPath string) (bool, error) {
+	release, err := p.osRelease(ip, sshKeyPath)
+	if err != nil {
+		return false, err
+	}
+	return isCoreOSRelease(release), nil
+}
+
+// isCoreOSRelease reports whether the contents of /etc/os-release
+// identify a CoreOS host.
+func isCoreOSRelease(release string) bool {
+	return strings.Contains(release, "ID=coreos")
+}
+
+func (p *coreOSProvisioner) InstallDocker(ip, sshKeyPath string) error {
+	// CoreOS ships Docker out of the box; nothing to install.
+	return nil
+}
+
+func (p *coreOSProvisioner) ConfigureDaemon(ip, sshKeyPath string, opts DaemonOpts) error {
+	return p.runAll(ip, sshKeyPath, []string{
+		"sudo mkdir -p /etc/systemd/system/docker.service.d",
+		fmt.Sprintf(
+			"printf '[Service]\\nExecStart=\\nExecStart=/usr/lib/coreos/dockerd %s\\n' | sudo tee /etc/systemd/system/docker.service.d/10-machine.conf",
+			opts.flags(),
+		),
+		"sudo systemctl daemon-reload",
+	})
+}
+
+func (p *coreOSProvisioner) RestartDocker(ip, sshKeyPath string) error {
+	return p.runAll(ip, sshKeyPath, []string{"sudo systemctl restart docker"})
+}
+
+func (p *coreOSProvisioner) UpgradeDocker(ip, sshKeyPath string) error {
+	return fmt.Errorf("docker on CoreOS is upgraded via CoreOS auto-updates; not supported by this driver")
+}
+
+// containerVMProvisioner is the legacy path for Google's container-vm
+// image, which predates systemd and configures the daemon via
+// /etc/default/docker.
+type containerVMProvisioner struct {
+	sshRunner
+}
+
+func (p *containerVMProvisioner) Detect(ip, sshKeyPath string) (bool, error) {
+	// container-vm has no /etc/os-release; it's the fallback when nothing
+	// else matches.
+	release, err := p.osRelease(ip, sshKeyPath)
+	if err != nil {
+		return false, err
+	}
+	return release == "", nil
+}
+
+func (p *containerVMProvisioner) InstallDocker(ip, sshKeyPath string) error {
+	// container-vm ships Docker out of the box; nothing to install.
+	return nil
+}
+
+func (p *containerVMProvisioner) ConfigureDaemon(ip, sshKeyPath string, opts DaemonOpts) error {
+	return p.runAll(ip, sshKeyPath, []string{
+		fmt.Sprintf("sudo sed -i 's#DOCKER_OPTS=.*#DOCKER_OPTS=\"%s\"#g' /etc/default/docker", opts.flags()),
+	})
+}
+
+func (p *containerVMProvisioner) RestartDocker(ip, sshKeyPath string) error {
+	return p.runAll(ip, sshKeyPath, []string{"sudo service docker restart"})
+}
+
+func (p *containerVMProvisioner) UpgradeDocker(ip, sshKeyPath string) error {
+	return p.runAll(ip, sshKeyPath, []string{
+		"sudo service docker stop",
+		"sleep 10",
+		"curl -sSL https://get.docker.com/ | sudo sh",
+		"sudo service docker start",
+	})
+}
+
+// detectProvisioner probes the instance at ip for the Provisioner that
+// applies to it, falling back to the legacy container-vm path when
+// nothing else matches. It returns an error instead of guessing when a
+// candidate's Detect can't tell one way or the other (e.g. the instance
+// isn't reachable over SSH yet), so a transient connectivity failure
+// can't be misread as "this must be container-vm".
+func detectProvisioner(userName, ip, sshKeyPath string) (Provisioner, error) {
+	candidates := []Provisioner{
+		&debianProvisioner{sshRunner{userName}},
+		&coreOSProvisioner{sshRunner{userName}},
+	}
+	for _, p := range candidates {
+		ok, err := p.Detect(ip, sshKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to detect instance base OS: %v", err)
+		}
+		if ok {
+			return p, nil
+		}
+	}
+	return &containerVMProvisioner{sshRunner{userName}}, nil
+}
@@ -0,0 +1,45 @@
+package gce
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsFileNotFound(t *testing.T) {
+	if isFileNotFound(nil) {
+		t.Error("isFileNotFound(nil) = true, want false")
+	}
+	if isFileNotFound(errors.New("exit status 1: No such file or directory")) != true {
+		t.Error("isFileNotFound(missing file error) = false, want true")
+	}
+	if isFileNotFound(errors.New("ssh: connect to host 1.2.3.4 port 22: Connection refused")) {
+		t.Error("isFileNotFound(connectivity error) = true, want false")
+	}
+	if isFileNotFound(errors.New("Permission denied (publickey)")) {
+		t.Error("isFileNotFound(auth error) = true, want false")
+	}
+}
+
+func TestIsDebianRelease(t *testing.T) {
+	if !isDebianRelease("NAME=\"Debian GNU/Linux\"\nID=debian\n") {
+		t.Error("isDebianRelease(debian) = false, want true")
+	}
+	if !isDebianRelease("NAME=\"Ubuntu\"\nID=ubuntu\n") {
+		t.Error("isDebianRelease(ubuntu) = false, want true")
+	}
+	if isDebianRelease("NAME=\"CoreOS\"\nID=coreos\n") {
+		t.Error("isDebianRelease(coreos) = true, want false")
+	}
+	if isDebianRelease("") {
+		t.Error("isDebianRelease(\"\") = true, want false")
+	}
+}
+
+func TestIsCoreOSRelease(t *testing.T) {
+	if !isCoreOSRelease("NAME=\"CoreOS\"\nID=coreos\n") {
+		t.Error("isCoreOSRelease(coreos) = false, want true")
+	}
+	if isCoreOSRelease("NAME=\"Debian GNU/Linux\"\nID=debian\n") {
+		t.Error("isCoreOSRelease(debian) = true, want false")
+	}
+}